@@ -0,0 +1,346 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+// Package generation holds the Go types accepted by the activity log's
+// testonly data generation endpoint. They mirror generate.proto by hand
+// instead of being generated from it: the endpoint only ever needs plain
+// JSON (de)serialization, so these types implement that directly with
+// encoding/json rather than pulling in a full protobuf runtime.
+package generation
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+)
+
+// WriteOperation enumerates the side effects that processing a piece of
+// ActivityLogMockInput can have. The testing endpoint requires at least one,
+// but does not act on which are listed: it always writes entity segments and
+// distinct-clients sketches, and never writes precomputed queries.
+type WriteOperation int32
+
+const (
+	WriteOperation_WRITE_ENTITIES            WriteOperation = 0
+	WriteOperation_WRITE_DISTINCT_CLIENTS    WriteOperation = 1
+	WriteOperation_WRITE_PRECOMPUTED_QUERIES WriteOperation = 2
+)
+
+var WriteOperation_name = map[int32]string{
+	0: "WRITE_ENTITIES",
+	1: "WRITE_DISTINCT_CLIENTS",
+	2: "WRITE_PRECOMPUTED_QUERIES",
+}
+
+var WriteOperation_value = map[string]int32{
+	"WRITE_ENTITIES":            0,
+	"WRITE_DISTINCT_CLIENTS":    1,
+	"WRITE_PRECOMPUTED_QUERIES": 2,
+}
+
+func (x WriteOperation) String() string {
+	if s, ok := WriteOperation_name[int32(x)]; ok {
+		return s
+	}
+	return fmt.Sprintf("WriteOperation(%d)", int32(x))
+}
+
+// MarshalJSON renders x as its enum name (e.g. "WRITE_ENTITIES"), matching
+// the JSON shape generate.proto's enum would produce.
+func (x WriteOperation) MarshalJSON() ([]byte, error) {
+	return json.Marshal(x.String())
+}
+
+// UnmarshalJSON accepts either an enum name or its numeric value, matching
+// the JSON shape generate.proto's enum would accept.
+func (x *WriteOperation) UnmarshalJSON(b []byte) error {
+	var name string
+	if err := json.Unmarshal(b, &name); err == nil {
+		v, ok := WriteOperation_value[name]
+		if !ok {
+			return fmt.Errorf("unknown WriteOperation %q", name)
+		}
+		*x = WriteOperation(v)
+		return nil
+	}
+
+	var n int32
+	if err := json.Unmarshal(b, &n); err != nil {
+		return fmt.Errorf("WriteOperation must be a string or number: %w", err)
+	}
+	*x = WriteOperation(n)
+	return nil
+}
+
+// ActivityLogMockInput is the top level message accepted by the activity log
+// testing endpoint.
+type ActivityLogMockInput struct {
+	Write []WriteOperation `json:"write,omitempty"`
+	Data  []*Data          `json:"data,omitempty"`
+}
+
+// UnmarshalJSON rejects any field other than write and data, so that a typo
+// or a client targeting a different shape fails loudly instead of being
+// silently ignored.
+func (x *ActivityLogMockInput) UnmarshalJSON(b []byte) error {
+	type alias ActivityLogMockInput
+	aux := (*alias)(x)
+
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.DisallowUnknownFields()
+	return dec.Decode(aux)
+}
+
+func (x *ActivityLogMockInput) GetWrite() []WriteOperation {
+	if x != nil {
+		return x.Write
+	}
+	return nil
+}
+
+func (x *ActivityLogMockInput) GetData() []*Data {
+	if x != nil {
+		return x.Data
+	}
+	return nil
+}
+
+// Data describes a single month of synthetic activity log data.
+type Data struct {
+	// Month is one of *Data_CurrentMonth or *Data_MonthsAgo.
+	Month isData_Month
+	// Clients is always *Data_All; it's a oneof for forwards compatibility
+	// with additional ways to describe a month's clients.
+	Clients isData_Clients
+
+	// Seed, if non-zero, reseeds the random source used for this month's
+	// weighted distributions and churn between months, so that how many
+	// clients each segment gets is the same on every run with the same input.
+	// A zero seed leaves the random source as the previous month left it.
+	// Client IDs are random UUIDs whatever the seed, so the IDs, and which
+	// prior-month clients a repeated group draws, differ between runs.
+	Seed int64
+}
+
+type isData_Month interface {
+	isData_Month()
+}
+
+type Data_CurrentMonth struct {
+	CurrentMonth bool
+}
+
+type Data_MonthsAgo struct {
+	MonthsAgo int32
+}
+
+func (*Data_CurrentMonth) isData_Month() {}
+func (*Data_MonthsAgo) isData_Month()    {}
+
+type isData_Clients interface {
+	isData_Clients()
+}
+
+type Data_All struct {
+	All *Clients
+}
+
+func (*Data_All) isData_Clients() {}
+
+// UnmarshalJSON reconstructs the month and clients oneofs from the
+// current_month/months_ago and all JSON fields, since encoding/json can't
+// unmarshal directly into an interface-typed field.
+func (x *Data) UnmarshalJSON(b []byte) error {
+	var raw struct {
+		CurrentMonth *bool    `json:"current_month"`
+		MonthsAgo    *int32   `json:"months_ago"`
+		All          *Clients `json:"all"`
+		Seed         int64    `json:"seed"`
+	}
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&raw); err != nil {
+		return err
+	}
+
+	switch {
+	case raw.CurrentMonth != nil:
+		x.Month = &Data_CurrentMonth{CurrentMonth: *raw.CurrentMonth}
+	case raw.MonthsAgo != nil:
+		x.Month = &Data_MonthsAgo{MonthsAgo: *raw.MonthsAgo}
+	}
+	if raw.All != nil {
+		x.Clients = &Data_All{All: raw.All}
+	}
+	x.Seed = raw.Seed
+	return nil
+}
+
+func (x *Data) GetMonth() isData_Month {
+	if x != nil {
+		return x.Month
+	}
+	return nil
+}
+
+func (x *Data) GetCurrentMonth() bool {
+	if x, ok := x.GetMonth().(*Data_CurrentMonth); ok {
+		return x.CurrentMonth
+	}
+	return false
+}
+
+func (x *Data) GetMonthsAgo() int32 {
+	if x, ok := x.GetMonth().(*Data_MonthsAgo); ok {
+		return x.MonthsAgo
+	}
+	return 0
+}
+
+func (x *Data) GetClients() isData_Clients {
+	if x != nil {
+		return x.Clients
+	}
+	return nil
+}
+
+func (x *Data) GetAll() *Clients {
+	if x, ok := x.GetClients().(*Data_All); ok {
+		return x.All
+	}
+	return nil
+}
+
+func (x *Data) GetSeed() int64 {
+	if x != nil {
+		return x.Seed
+	}
+	return 0
+}
+
+// Clients is an unsharded list of clients to add to a month.
+type Clients struct {
+	Clients []*Client `json:"clients,omitempty"`
+}
+
+func (x *Clients) GetClients() []*Client {
+	if x != nil {
+		return x.Clients
+	}
+	return nil
+}
+
+// Client describes either a single client, or (via count/times_seen) a
+// batch of clients sharing the same namespace, mount, and entity-ness.
+type Client struct {
+	Id        string            `json:"id,omitempty"`
+	Namespace string            `json:"namespace,omitempty"`
+	Mount     string            `json:"mount,omitempty"`
+	NonEntity bool              `json:"non_entity,omitempty"`
+	Count     int64             `json:"count,omitempty"`
+	TimesSeen int64             `json:"times_seen,omitempty"`
+	Segments  []*Client_Segment `json:"segments,omitempty"`
+
+	RepeatedFromMonth int32 `json:"repeated_from_month,omitempty"`
+	Repeated          int64 `json:"repeated,omitempty"`
+}
+
+func (x *Client) GetId() string {
+	if x != nil {
+		return x.Id
+	}
+	return ""
+}
+
+func (x *Client) GetNamespace() string {
+	if x != nil {
+		return x.Namespace
+	}
+	return ""
+}
+
+func (x *Client) GetMount() string {
+	if x != nil {
+		return x.Mount
+	}
+	return ""
+}
+
+func (x *Client) GetNonEntity() bool {
+	if x != nil {
+		return x.NonEntity
+	}
+	return false
+}
+
+func (x *Client) GetCount() int64 {
+	if x != nil {
+		return x.Count
+	}
+	return 0
+}
+
+func (x *Client) GetTimesSeen() int64 {
+	if x != nil {
+		return x.TimesSeen
+	}
+	return 0
+}
+
+func (x *Client) GetSegments() []*Client_Segment {
+	if x != nil {
+		return x.Segments
+	}
+	return nil
+}
+
+func (x *Client) GetRepeatedFromMonth() int32 {
+	if x != nil {
+		return x.RepeatedFromMonth
+	}
+	return 0
+}
+
+func (x *Client) GetRepeated() int64 {
+	if x != nil {
+		return x.Repeated
+	}
+	return 0
+}
+
+// Client_Segment is one bucket of a weighted distribution of clients
+// sharing a namespace, mount, and entity-ness.
+type Client_Segment struct {
+	Weight    float64 `json:"weight,omitempty"`
+	Namespace string  `json:"namespace,omitempty"`
+	Mount     string  `json:"mount,omitempty"`
+	NonEntity bool    `json:"non_entity,omitempty"`
+}
+
+func (x *Client_Segment) GetWeight() float64 {
+	if x != nil {
+		return x.Weight
+	}
+	return 0
+}
+
+func (x *Client_Segment) GetNamespace() string {
+	if x != nil {
+		return x.Namespace
+	}
+	return ""
+}
+
+func (x *Client_Segment) GetMount() string {
+	if x != nil {
+		return x.Mount
+	}
+	return ""
+}
+
+func (x *Client_Segment) GetNonEntity() bool {
+	if x != nil {
+		return x.NonEntity
+	}
+	return false
+}
@@ -0,0 +1,632 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+//go:build testonly
+
+package vault
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"math"
+	"math/rand"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/axiomhq/hyperloglog"
+	"github.com/golang/protobuf/proto"
+	"github.com/hashicorp/go-uuid"
+	"github.com/hashicorp/vault/helper/namespace"
+	"github.com/hashicorp/vault/helper/timeutil"
+	"github.com/hashicorp/vault/sdk/logical"
+	"github.com/hashicorp/vault/vault/activity"
+	"github.com/hashicorp/vault/vault/activity/generation"
+)
+
+// csvHeader is the column order used by writeCSV and expected by readCSV.
+var csvHeader = []string{"months_ago", "namespace", "mount", "client_id", "non_entity", "count", "times_seen"}
+
+// maxGeneratedClientsPerGroup bounds how many clients a single
+// generation.Client can expand to, so that a pathological count can't be
+// used to exhaust memory generating test data.
+const maxGeneratedClientsPerGroup = 100_000
+
+// maxGeneratedMonths bounds how many months of data can be generated or
+// exported in a single request, so that a pathological months_ago or months
+// value can't be used to exhaust memory allocating that many months up
+// front.
+const maxGeneratedMonths = 36
+
+// distinctClientsBasePath parallels activityEntityBasePath, but holds the
+// per-month HyperLogLog sketches used to estimate distinct client counts
+// instead of the full entity records.
+const distinctClientsBasePath = "log/distinctclients/"
+
+// clientIDHash hashes a client ID the same way the activity log does when
+// inserting into its distinct-clients sketches, so that sketches generated
+// here produce the same estimates the real precomputation would.
+func clientIDHash(clientID string) []byte {
+	hash := sha256.Sum256([]byte(clientID))
+	return hash[:]
+}
+
+// singleMonthActivityClients holds the generated clients for a single month
+// of activity log data.
+type singleMonthActivityClients struct {
+	// clients holds one entry per (client, times seen) pair, so a client
+	// that was seen 3 times in the month appears 3 times in this slice.
+	clients []string
+
+	// allClients indexes the distinct clients generated for this month by
+	// client ID.
+	allClients map[string]*activity.EntityRecord
+}
+
+// addNewClients adds the clients described by c to the month, using
+// defaultNamespace and defaultMount whenever c doesn't specify its own. If c
+// doesn't specify a client ID, one is generated for each client.
+func (m *singleMonthActivityClients) addNewClients(c *generation.Client, defaultNamespace, defaultMount string) error {
+	count := c.Count
+	if count == 0 {
+		count = 1
+	}
+	if count > maxGeneratedClientsPerGroup {
+		return fmt.Errorf("count %d exceeds the maximum of %d clients per group", count, maxGeneratedClientsPerGroup)
+	}
+	timesSeen := c.TimesSeen
+	if timesSeen == 0 {
+		timesSeen = 1
+	}
+	if c.Id != "" && count > 1 {
+		return fmt.Errorf("cannot specify a client ID when count is greater than 1")
+	}
+
+	ns := c.Namespace
+	if ns == "" {
+		ns = defaultNamespace
+	}
+	mount := c.Mount
+	if mount == "" {
+		mount = defaultMount
+	}
+
+	for i := int64(0); i < count; i++ {
+		id := c.Id
+		if id == "" {
+			var err error
+			id, err = uuid.GenerateUUID()
+			if err != nil {
+				return err
+			}
+		}
+
+		m.allClients[id] = &activity.EntityRecord{
+			ClientID:      id,
+			NamespaceID:   ns,
+			MountAccessor: mount,
+			NonEntity:     c.NonEntity,
+		}
+		for j := int64(0); j < timesSeen; j++ {
+			m.clients = append(m.clients, id)
+		}
+	}
+	return nil
+}
+
+// distinctClientsSketch builds a HyperLogLog sketch over every distinct
+// client generated for the month, so that the distinct-clients
+// precomputation path can be exercised without real fragments.
+func (m *singleMonthActivityClients) distinctClientsSketch() *hyperloglog.Sketch {
+	sketch := hyperloglog.New()
+	for id := range m.allClients {
+		sketch.Insert(clientIDHash(id))
+	}
+	return sketch
+}
+
+// writeCSV serializes the month's clients to w in the repeated
+// months_ago,namespace,mount,client_id,non_entity,count,times_seen format
+// shared across all months of a multipleMonthsActivityClients, so that it can
+// be diffed against the CSV that was used to generate it.
+func (m *singleMonthActivityClients) writeCSV(w *csv.Writer, monthsAgo int) error {
+	timesSeen := make(map[string]int64, len(m.allClients))
+	for _, id := range m.clients {
+		timesSeen[id]++
+	}
+	for id, rec := range m.allClients {
+		record := []string{
+			strconv.Itoa(monthsAgo),
+			rec.NamespaceID,
+			rec.MountAccessor,
+			id,
+			strconv.FormatBool(rec.NonEntity),
+			"1",
+			strconv.FormatInt(timesSeen[id], 10),
+		}
+		if err := w.Write(record); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// multipleMonthsActivityClients holds generated clients for every month
+// being generated, keyed by the number of months ago each month occurred
+// (0 is the current month).
+type multipleMonthsActivityClients struct {
+	months     []*singleMonthActivityClients
+	allClients map[string]*activity.EntityRecord
+
+	// rng drives every deterministic-but-reproducible decision made while
+	// generating clients, such as distributing a segmented client count's
+	// remainder. It starts from a fixed seed of 0 and is reseeded by every
+	// generation.Data processed that sets a non-zero seed.
+	rng *rand.Rand
+}
+
+// newMultipleMonthsActivityClients creates an empty multipleMonthsActivityClients
+// with numMonths months available, indexed 0 (the current month) through
+// numMonths-1.
+func newMultipleMonthsActivityClients(numMonths int) *multipleMonthsActivityClients {
+	months := make([]*singleMonthActivityClients, numMonths)
+	for i := range months {
+		months[i] = &singleMonthActivityClients{
+			allClients: make(map[string]*activity.EntityRecord),
+		}
+	}
+	return &multipleMonthsActivityClients{
+		months:     months,
+		allClients: make(map[string]*activity.EntityRecord),
+		rng:        rand.New(rand.NewSource(0)),
+	}
+}
+
+// distributeWeighted splits total across len(weights) buckets in proportion
+// to weights (which need not sum to 1), assigning the integer division
+// remainder one unit at a time to randomly chosen buckets so that repeated
+// calls with the same rng are reproducible. A non-positive sum of weights
+// (including the proto3 zero value left on every segment) is treated as a
+// request for an even split rather than producing almost no clients.
+func distributeWeighted(total int64, weights []float64, rng *rand.Rand) []int64 {
+	sum := 0.0
+	for _, w := range weights {
+		sum += w
+	}
+	if sum <= 0 {
+		weights = make([]float64, len(weights))
+		for i := range weights {
+			weights[i] = 1
+		}
+		sum = float64(len(weights))
+	}
+
+	counts := make([]int64, len(weights))
+	var assigned int64
+	for i, w := range weights {
+		counts[i] = int64(math.Floor(float64(total) * w / sum))
+		assigned += counts[i]
+	}
+
+	remaining := total - assigned
+	for _, i := range rng.Perm(len(weights)) {
+		if remaining <= 0 {
+			break
+		}
+		counts[i]++
+		remaining--
+	}
+	return counts
+}
+
+// repeatedClientsToApply pairs a generation.Client that specified a Repeated
+// count with the specific client IDs resolveRepeatedClients chose to copy
+// into its month, so that processMonth can apply them only once the whole
+// month has been validated.
+type repeatedClientsToApply struct {
+	client *generation.Client
+	ids    []string
+}
+
+// resolveRepeatedClients validates c's Repeated/RepeatedFromMonth fields
+// against the months generated so far and picks the specific client IDs that
+// should be copied from c.RepeatedFromMonth, without mutating any month
+// state. Keeping this side-effect free lets processMonth validate every
+// client in a month, including its repeated groups, before committing any of
+// them. The referenced month must already have been processed and have
+// enough clients to draw from.
+func (m *multipleMonthsActivityClients) resolveRepeatedClients(c *generation.Client) ([]string, error) {
+	count := c.Count
+	if count == 0 {
+		count = 1
+	}
+	if c.Repeated < 0 || c.Repeated > count {
+		return nil, fmt.Errorf("repeated value %d must be between 0 and count (%d)", c.Repeated, count)
+	}
+
+	srcMonthsAgo := int(c.RepeatedFromMonth)
+	if srcMonthsAgo < 0 || srcMonthsAgo >= len(m.months) {
+		return nil, fmt.Errorf("repeated_from_month %d is out of range", srcMonthsAgo)
+	}
+	src := m.months[srcMonthsAgo]
+	if int64(len(src.allClients)) < c.Repeated {
+		return nil, fmt.Errorf("month %d ago only has %d clients generated, cannot repeat %d", srcMonthsAgo, len(src.allClients), c.Repeated)
+	}
+
+	ids := make([]string, 0, len(src.allClients))
+	for id := range src.allClients {
+		ids = append(ids, id)
+	}
+	// Sort first so that the subsequent shuffle is reproducible across
+	// platforms, where map iteration order isn't.
+	sort.Strings(ids)
+	m.rng.Shuffle(len(ids), func(i, j int) { ids[i], ids[j] = ids[j], ids[i] })
+	return ids[:c.Repeated], nil
+}
+
+// applyRepeatedClients copies the ids resolveRepeatedClients chose for c from
+// c.RepeatedFromMonth's allClients into monthsAgo, modeling clients that
+// return across months rather than appearing for the first time.
+func (m *multipleMonthsActivityClients) applyRepeatedClients(monthsAgo int, c *generation.Client, ids []string) {
+	src := m.months[int(c.RepeatedFromMonth)]
+
+	timesSeen := c.TimesSeen
+	if timesSeen == 0 {
+		timesSeen = 1
+	}
+
+	dst := m.months[monthsAgo]
+	for _, id := range ids {
+		rec := src.allClients[id]
+		dst.allClients[id] = rec
+		for i := int64(0); i < timesSeen; i++ {
+			dst.clients = append(dst.clients, id)
+		}
+		m.allClients[id] = rec
+	}
+}
+
+// repeatedClientsBetween returns how many distinct clients appear in both
+// monthA and monthB's generated data, for verifying that the activity log's
+// new-vs-returning precomputation matches what was declared via Repeated.
+func (m *multipleMonthsActivityClients) repeatedClientsBetween(monthA, monthB int) int {
+	if monthA < 0 || monthA >= len(m.months) || monthB < 0 || monthB >= len(m.months) {
+		return 0
+	}
+
+	count := 0
+	for id := range m.months[monthA].allClients {
+		if _, ok := m.months[monthB].allClients[id]; ok {
+			count++
+		}
+	}
+	return count
+}
+
+// processMonth adds the clients described by month to the corresponding
+// singleMonthActivityClients. All referenced namespaces and mounts are
+// resolved and validated, and every repeated-client group is resolved
+// against its source month, before any client is added or any repeat is
+// applied, so that a single bad reference fails the whole month atomically
+// rather than leaving it partially populated.
+func (m *multipleMonthsActivityClients) processMonth(ctx context.Context, core *Core, month *generation.Data) error {
+	monthsAgo := int(month.GetMonthsAgo())
+	if monthsAgo < 0 || monthsAgo >= len(m.months) {
+		return fmt.Errorf("monthsAgo value %d is out of range for the %d months being generated", monthsAgo, len(m.months))
+	}
+
+	var newClients []*generation.Client
+	switch c := month.GetClients().(type) {
+	case *generation.Data_All:
+		newClients = c.All.GetClients()
+	default:
+		return fmt.Errorf("no clients specified for month %d", monthsAgo)
+	}
+
+	if seed := month.GetSeed(); seed != 0 {
+		m.rng = rand.New(rand.NewSource(seed))
+	}
+
+	// Clients with a Repeated count are drawn from a prior month's already
+	// generated clients rather than freshly validated, so pull them out of
+	// newClients up front. They're only resolved here, not applied: applying
+	// them is deferred until every client in the month (including the
+	// remainder generated below) has been validated, so that a later failure
+	// doesn't leave already-applied repeats stranded. Any remainder (Count -
+	// Repeated) still needs to be newly generated, so it's fed back in as a
+	// plain client.
+	var pendingRepeats []repeatedClientsToApply
+	pipelineClients := make([]*generation.Client, 0, len(newClients))
+	for i, c := range newClients {
+		if c == nil {
+			return fmt.Errorf("client %d of month %d is null", i, monthsAgo)
+		}
+		for j, seg := range c.Segments {
+			if seg == nil {
+				return fmt.Errorf("segment %d of client %d of month %d is null", j, i, monthsAgo)
+			}
+		}
+		if c.Count > maxGeneratedClientsPerGroup {
+			return fmt.Errorf("count %d exceeds the maximum of %d clients per group", c.Count, maxGeneratedClientsPerGroup)
+		}
+		if c.Repeated == 0 {
+			pipelineClients = append(pipelineClients, c)
+			continue
+		}
+		ids, err := m.resolveRepeatedClients(c)
+		if err != nil {
+			return err
+		}
+		pendingRepeats = append(pendingRepeats, repeatedClientsToApply{client: c, ids: ids})
+		if remaining := c.Count - c.Repeated; remaining > 0 {
+			pipelineClients = append(pipelineClients, &generation.Client{
+				Namespace: c.Namespace,
+				Mount:     c.Mount,
+				NonEntity: c.NonEntity,
+				Count:     remaining,
+				TimesSeen: c.TimesSeen,
+				Segments:  c.Segments,
+			})
+		}
+	}
+	newClients = pipelineClients
+
+	// expandSegments turns a single generation.Client that describes a
+	// weighted distribution into the list of per-segment clients it expands
+	// to, or returns c itself unchanged if it has no segments.
+	expandSegments := func(c *generation.Client) []*generation.Client {
+		if len(c.Segments) == 0 {
+			return []*generation.Client{c}
+		}
+
+		total := c.Count
+		if total == 0 {
+			total = 1
+		}
+		weights := make([]float64, len(c.Segments))
+		for i, seg := range c.Segments {
+			weights[i] = seg.Weight
+		}
+		counts := distributeWeighted(total, weights, m.rng)
+
+		expanded := make([]*generation.Client, 0, len(c.Segments))
+		for i, seg := range c.Segments {
+			if counts[i] == 0 {
+				continue
+			}
+			ns := seg.Namespace
+			if ns == "" {
+				ns = c.Namespace
+			}
+			mount := seg.Mount
+			if mount == "" {
+				mount = c.Mount
+			}
+			expanded = append(expanded, &generation.Client{
+				Namespace: ns,
+				Mount:     mount,
+				NonEntity: seg.NonEntity,
+				Count:     counts[i],
+				TimesSeen: c.TimesSeen,
+			})
+		}
+		return expanded
+	}
+
+	type resolvedClient struct {
+		client *generation.Client
+		nsID   string
+		mount  string
+	}
+	resolved := make([]resolvedClient, 0, len(newClients))
+	for _, c := range newClients {
+		for _, ec := range expandSegments(c) {
+			nsID := ec.Namespace
+			if nsID == "" {
+				nsID = namespace.RootNamespaceID
+			}
+			ns, err := core.NamespaceByID(ctx, nsID)
+			if err != nil {
+				return err
+			}
+			if ns == nil {
+				return fmt.Errorf("no namespace found with ID %q", nsID)
+			}
+
+			mount := ec.Mount
+			if mount == "" {
+				mount = "identity/"
+			}
+			nsCtx := namespace.ContextWithNamespace(ctx, ns)
+			if entry := core.router.MatchingMountEntry(nsCtx, mount); entry == nil {
+				return fmt.Errorf("no mount found with path %q in namespace %q", mount, nsID)
+			}
+
+			resolved = append(resolved, resolvedClient{client: ec, nsID: nsID, mount: mount})
+		}
+	}
+
+	// Every client has now been validated, so mutate a scratch month instead
+	// of the real one: if addNewClients fails partway through (e.g. a
+	// pathological count), nothing committed so far needs to be unwound.
+	scratch := &singleMonthActivityClients{allClients: make(map[string]*activity.EntityRecord)}
+	for _, rc := range resolved {
+		if err := scratch.addNewClients(rc.client, rc.nsID, rc.mount); err != nil {
+			return err
+		}
+	}
+
+	// Only now, with the whole month validated and generated, commit it:
+	// apply the repeated clients resolved above, then merge the scratch
+	// month's newly generated clients in.
+	for _, pr := range pendingRepeats {
+		m.applyRepeatedClients(monthsAgo, pr.client, pr.ids)
+	}
+	singleMonth := m.months[monthsAgo]
+	singleMonth.clients = append(singleMonth.clients, scratch.clients...)
+	for id, rec := range scratch.allClients {
+		singleMonth.allClients[id] = rec
+	}
+	for id, rec := range singleMonth.allClients {
+		m.allClients[id] = rec
+	}
+	return nil
+}
+
+// writeSegments writes each non-empty month to storage as a single activity
+// log segment, plus a HyperLogLog sketch of its distinct clients under
+// distinctClientsBasePath, and returns the segment paths that were written
+// to (the sketch paths are not included). The
+// current month (monthsAgo 0) is also loaded into the in-memory activity log
+// so that it is reflected by the normal activity log APIs immediately,
+// matching what happens when fragments are rolled over in production.
+func (m *multipleMonthsActivityClients) writeSegments(ctx context.Context, al *ActivityLog, now time.Time) ([]string, error) {
+	var paths []string
+	for monthsAgo, month := range m.months {
+		if len(month.clients) == 0 {
+			continue
+		}
+
+		records := make([]*activity.EntityRecord, 0, len(month.clients))
+		for _, id := range month.clients {
+			records = append(records, m.allClients[id])
+		}
+		entityLog := &activity.EntityActivityLog{Clients: records}
+		data, err := proto.Marshal(entityLog)
+		if err != nil {
+			return nil, err
+		}
+
+		monthTimestamp := timeutil.StartOfMonth(now.AddDate(0, -monthsAgo, 0))
+		path := al.entityPath(monthTimestamp, 0)
+		if err := al.view.Put(ctx, &logical.StorageEntry{Key: path, Value: data}); err != nil {
+			return nil, err
+		}
+		paths = append(paths, path)
+
+		sketchData, err := month.distinctClientsSketch().MarshalBinary()
+		if err != nil {
+			return nil, err
+		}
+		sketchPath := distinctClientsBasePath + monthTimestamp.Format(time.RFC3339)
+		if err := al.view.Put(ctx, &logical.StorageEntry{Key: sketchPath, Value: sketchData}); err != nil {
+			return nil, err
+		}
+
+		if monthsAgo == 0 {
+			al.SetCurrentEntities(entityLog)
+		}
+	}
+	return paths, nil
+}
+
+// writeCSV serializes every month currently loaded into m to w, in
+// months_ago,namespace,mount,client_id,non_entity,count,times_seen order, one
+// row per distinct client. This lets the state generated so far be diffed
+// against the CSV that produced it.
+func (m *multipleMonthsActivityClients) writeCSV(w io.Writer) error {
+	cw := csv.NewWriter(w)
+	if err := cw.Write(csvHeader); err != nil {
+		return err
+	}
+	for monthsAgo, month := range m.months {
+		if err := month.writeCSV(cw, monthsAgo); err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// loadMonthsFromStorage reads back the numMonths most recent months of
+// activity log segments written by writeSegments, so that the generated
+// state can be exported and diffed against the CSV that produced it.
+func loadMonthsFromStorage(ctx context.Context, al *ActivityLog, now time.Time, numMonths int) (*multipleMonthsActivityClients, error) {
+	months := newMultipleMonthsActivityClients(numMonths)
+	for monthsAgo := 0; monthsAgo < numMonths; monthsAgo++ {
+		monthTimestamp := timeutil.StartOfMonth(now.AddDate(0, -monthsAgo, 0))
+		path := al.entityPath(monthTimestamp, 0)
+		entry, err := al.view.Get(ctx, path)
+		if err != nil {
+			return nil, err
+		}
+		if entry == nil {
+			continue
+		}
+
+		var entityLog activity.EntityActivityLog
+		if err := proto.Unmarshal(entry.Value, &entityLog); err != nil {
+			return nil, err
+		}
+
+		single := months.months[monthsAgo]
+		for _, rec := range entityLog.Clients {
+			single.allClients[rec.ClientID] = rec
+			single.clients = append(single.clients, rec.ClientID)
+			months.allClients[rec.ClientID] = rec
+		}
+	}
+	return months, nil
+}
+
+// readCSV parses rows in the months_ago,namespace,mount,client_id,non_entity,
+// count,times_seen format written by writeCSV, turning each row into the
+// generation.Client it would take to reproduce that row, grouped by the
+// month it belongs to. The header row, if present, is skipped. A row's
+// client_id is only meaningful when its count is 1, since every generated
+// client needs a distinct ID; readCSV rejects a row that combines a
+// non-empty client_id with a count greater than 1 instead of silently
+// generating just one client.
+func readCSV(r io.Reader) (map[int]*generation.Clients, error) {
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = len(csvHeader)
+
+	rows, err := cr.ReadAll()
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse CSV: %w", err)
+	}
+	if len(rows) > 0 && rows[0][0] == csvHeader[0] {
+		rows = rows[1:]
+	}
+
+	byMonth := make(map[int]*generation.Clients)
+	for i, row := range rows {
+		monthsAgo, err := strconv.Atoi(row[0])
+		if err != nil {
+			return nil, fmt.Errorf("invalid months_ago on row %d: %w", i, err)
+		}
+		nonEntity, err := strconv.ParseBool(row[4])
+		if err != nil {
+			return nil, fmt.Errorf("invalid non_entity on row %d: %w", i, err)
+		}
+		count, err := strconv.ParseInt(row[5], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid count on row %d: %w", i, err)
+		}
+		timesSeen, err := strconv.ParseInt(row[6], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid times_seen on row %d: %w", i, err)
+		}
+		if row[3] != "" && count > 1 {
+			return nil, fmt.Errorf("row %d specifies both a client_id and a count greater than 1", i)
+		}
+
+		client := &generation.Client{
+			Namespace: row[1],
+			Mount:     row[2],
+			Id:        row[3],
+			NonEntity: nonEntity,
+			Count:     count,
+			TimesSeen: timesSeen,
+		}
+
+		if _, ok := byMonth[monthsAgo]; !ok {
+			byMonth[monthsAgo] = &generation.Clients{}
+		}
+		byMonth[monthsAgo].Clients = append(byMonth[monthsAgo].Clients, client)
+	}
+	return byMonth, nil
+}
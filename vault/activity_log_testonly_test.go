@@ -0,0 +1,148 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+//go:build testonly
+
+package vault
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"math/rand"
+	"testing"
+
+	"github.com/hashicorp/vault/helper/namespace"
+	"github.com/hashicorp/vault/vault/activity"
+	"github.com/hashicorp/vault/vault/activity/generation"
+	"github.com/stretchr/testify/require"
+)
+
+// Test_multipleMonthsActivityClients_writeSketches verifies that the
+// HyperLogLog sketch generated for a month estimates the true number of
+// distinct clients to within 2%.
+func Test_multipleMonthsActivityClients_writeSketches(t *testing.T) {
+	const numClients = 10_000
+
+	months := newMultipleMonthsActivityClients(1)
+	month := months.months[0]
+	for i := 0; i < numClients; i++ {
+		id := fmt.Sprintf("client-%d", i)
+		month.allClients[id] = &activity.EntityRecord{ClientID: id}
+	}
+
+	sketch := month.distinctClientsSketch()
+	estimate := sketch.Estimate()
+
+	wantLow := uint64(math.Floor(numClients * 0.98))
+	wantHigh := uint64(math.Ceil(numClients * 1.02))
+	require.GreaterOrEqual(t, estimate, wantLow)
+	require.LessOrEqual(t, estimate, wantHigh)
+}
+
+// Test_distributeWeighted verifies that distributeWeighted splits a total
+// count proportionally to the given weights, always accounting for every
+// client, and that it's reproducible given the same rng seed.
+func Test_distributeWeighted(t *testing.T) {
+	weights := []float64{0.6, 0.3, 0.1}
+
+	counts := distributeWeighted(10_000, weights, rand.New(rand.NewSource(42)))
+	require.Len(t, counts, 3)
+
+	var total int64
+	for _, c := range counts {
+		total += c
+	}
+	require.Equal(t, int64(10_000), total)
+	require.InDelta(t, 6000, counts[0], 50)
+	require.InDelta(t, 3000, counts[1], 50)
+	require.InDelta(t, 1000, counts[2], 50)
+
+	again := distributeWeighted(10_000, weights, rand.New(rand.NewSource(42)))
+	require.Equal(t, counts, again)
+}
+
+// Test_distributeWeighted_zeroWeights verifies that leaving every weight at
+// its proto3 zero value is treated as a request for an even split, rather
+// than producing almost no clients.
+func Test_distributeWeighted_zeroWeights(t *testing.T) {
+	counts := distributeWeighted(100, []float64{0, 0, 0}, rand.New(rand.NewSource(1)))
+	require.Len(t, counts, 3)
+
+	var total int64
+	for _, c := range counts {
+		total += c
+		require.InDelta(t, 33, c, 1)
+	}
+	require.Equal(t, int64(100), total)
+}
+
+// Test_multipleMonthsActivityClients_processMonth_segments verifies that a
+// client with a weighted Segments distribution expands into clients across
+// each (namespace, mount, non_entity) tuple, in proportion to its weight.
+func Test_multipleMonthsActivityClients_processMonth_segments(t *testing.T) {
+	core, _, _ := TestCoreUnsealed(t)
+
+	m := newMultipleMonthsActivityClients(1)
+	data := &generation.Data{
+		Seed: 99,
+		Clients: &generation.Data_All{All: &generation.Clients{Clients: []*generation.Client{
+			{
+				Count: 100,
+				Segments: []*generation.Client_Segment{
+					{Weight: 1, Namespace: namespace.RootNamespaceID, Mount: "identity/"},
+					{Weight: 1, Namespace: namespace.RootNamespaceID, Mount: "identity/", NonEntity: true},
+				},
+			},
+		}}},
+	}
+
+	err := m.processMonth(context.Background(), core, data)
+	require.NoError(t, err)
+	require.Len(t, m.allClients, 100)
+
+	var numNonEntity int
+	for _, c := range m.allClients {
+		if c.NonEntity {
+			numNonEntity++
+		}
+	}
+	require.InDelta(t, 50, numNonEntity, 1)
+}
+
+// Test_multipleMonthsActivityClients_processMonth_repeated verifies that a
+// client group with a Repeated count draws that many clients from the
+// referenced prior month, and that repeatedClientsBetween reports the same
+// count the generator declared.
+func Test_multipleMonthsActivityClients_processMonth_repeated(t *testing.T) {
+	core, _, _ := TestCoreUnsealed(t)
+	ctx := context.Background()
+
+	m := newMultipleMonthsActivityClients(2)
+
+	// 1 month ago: 100 brand new clients.
+	err := m.processMonth(ctx, core, &generation.Data{
+		Month: &generation.Data_MonthsAgo{MonthsAgo: 1},
+		Clients: &generation.Data_All{All: &generation.Clients{Clients: []*generation.Client{{
+			Namespace: namespace.RootNamespaceID,
+			Mount:     "identity/",
+			Count:     100,
+		}}}},
+	})
+	require.NoError(t, err)
+
+	// current month: 40 of those clients return, 60 are new.
+	err = m.processMonth(ctx, core, &generation.Data{
+		Clients: &generation.Data_All{All: &generation.Clients{Clients: []*generation.Client{{
+			Namespace:         namespace.RootNamespaceID,
+			Mount:             "identity/",
+			Count:             100,
+			Repeated:          40,
+			RepeatedFromMonth: 1,
+		}}}},
+	})
+	require.NoError(t, err)
+
+	require.Len(t, m.months[0].allClients, 100)
+	require.Equal(t, 40, m.repeatedClientsBetween(0, 1))
+}
@@ -0,0 +1,214 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+//go:build testonly
+
+package vault
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"runtime/debug"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/logical"
+
+	"github.com/hashicorp/vault/vault/activity/generation"
+)
+
+// testOnlyActivityPaths returns the test-only paths that let callers
+// generate synthetic activity log data, for exercising the precomputation
+// and reporting paths without standing up real fragments. These are only
+// compiled in with the testonly build tag, and should never be reachable in
+// a production binary.
+func (b *SystemBackend) testOnlyActivityPaths() []*framework.Path {
+	return []*framework.Path{
+		{
+			Pattern: "internal/counters/activity/write$",
+			Fields: map[string]*framework.FieldSchema{
+				"input": {
+					Type:        framework.TypeString,
+					Description: "JSON or CSV-encoded generation.ActivityLogMockInput describing the months of activity log data to generate",
+				},
+				"format": {
+					Type:        framework.TypeString,
+					Default:     "json",
+					Description: "Format of the input field, either \"json\" (a JSON-encoded ActivityLogMockInput) or \"csv\" (months_ago,namespace,mount,client_id,non_entity,count,times_seen rows)",
+				},
+			},
+			Operations: map[logical.Operation]framework.OperationHandler{
+				logical.CreateOperation: &framework.PathOperation{
+					Callback: b.handleActivityWriteDataSafely,
+					Summary:  "Write activity log data for testing purposes.",
+				},
+			},
+		},
+		{
+			Pattern: "internal/counters/activity/export$",
+			Fields: map[string]*framework.FieldSchema{
+				"months": {
+					Type:        framework.TypeInt,
+					Default:     12,
+					Description: "Number of months, including the current month, to export",
+				},
+			},
+			Operations: map[logical.Operation]framework.OperationHandler{
+				logical.ReadOperation: &framework.PathOperation{
+					Callback: b.handleActivityExportCSV,
+					Summary:  "Export generated activity log client counters as CSV, for diffing against the CSV that generated them.",
+				},
+			},
+		},
+	}
+}
+
+// handleActivityWriteDataSafely wraps handleActivityWriteData with a
+// recovery interceptor, similar to the gRPC recovery interceptors used by
+// other HashiCorp servers. This endpoint accepts arbitrary JSON or CSV
+// describing how to generate activity log data, and a malformed
+// generation.Data can otherwise panic and crash core, so any panic raised by
+// handleActivityWriteData or the processMonth/writeSegments calls it makes
+// is converted into a logical.ErrInternal response carrying a redacted
+// stack, instead of unwinding further.
+func (b *SystemBackend) handleActivityWriteDataSafely(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	return b.withActivityWriteRecovery(func() (*logical.Response, error) {
+		return b.handleActivityWriteData(ctx, req, d)
+	})
+}
+
+// withActivityWriteRecovery invokes fn and converts any panic it raises into
+// a logical.ErrInternal error with an error response carrying a redacted
+// stack trace, which is also logged, instead of letting the panic unwind
+// further. It's factored out of
+// handleActivityWriteDataSafely so the recovery behavior itself can be
+// tested directly, without needing a generation bug to trigger it.
+func (b *SystemBackend) withActivityWriteRecovery(fn func() (*logical.Response, error)) (resp *logical.Response, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			stack := redactStack(debug.Stack())
+			b.logger.Error("panic generating activity log test data", "error", r, "stack", stack)
+			resp = logical.ErrorResponse("panic generating activity log test data: %v\n%s", r, stack)
+			err = logical.ErrInternal
+		}
+	}()
+	return fn()
+}
+
+// redactStack strips file paths from a debug.Stack() trace, keeping only
+// function names, so that a panic response or log line doesn't leak the
+// local filesystem layout.
+func redactStack(stack []byte) string {
+	var out strings.Builder
+	for _, line := range strings.Split(string(stack), "\n") {
+		if strings.Contains(line, ".go:") {
+			out.WriteString("\t<redacted>\n")
+			continue
+		}
+		out.WriteString(line)
+		out.WriteString("\n")
+	}
+	return out.String()
+}
+
+// handleActivityWriteData parses and validates the generation input, then
+// writes the described months of synthetic activity log data to storage.
+func (b *SystemBackend) handleActivityWriteData(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	rawInput := d.Get("input").(string)
+	format := d.Get("format").(string)
+
+	input := &generation.ActivityLogMockInput{}
+	switch format {
+	case "", "json":
+		if rawInput == "" {
+			return nil, logical.ErrInvalidRequest
+		}
+		if err := json.Unmarshal([]byte(rawInput), input); err != nil {
+			return logical.ErrorResponse("failed to parse input: %s", err), logical.ErrInvalidRequest
+		}
+	case "csv":
+		byMonth, err := readCSV(bytes.NewBufferString(rawInput))
+		if err != nil {
+			return logical.ErrorResponse("failed to parse CSV input: %s", err), logical.ErrInvalidRequest
+		}
+		input.Write = []generation.WriteOperation{generation.WriteOperation_WRITE_ENTITIES, generation.WriteOperation_WRITE_PRECOMPUTED_QUERIES}
+		for monthsAgo, clients := range byMonth {
+			data := &generation.Data{Clients: &generation.Data_All{All: clients}}
+			if monthsAgo != 0 {
+				data.Month = &generation.Data_MonthsAgo{MonthsAgo: int32(monthsAgo)}
+			}
+			input.Data = append(input.Data, data)
+		}
+	default:
+		return logical.ErrorResponse("unrecognized format %q", format), logical.ErrInvalidRequest
+	}
+
+	if len(input.Write) == 0 {
+		return logical.ErrorResponse("write must specify at least one operation"), logical.ErrInvalidRequest
+	}
+	if len(input.Data) == 0 {
+		return logical.ErrorResponse("data must specify at least one month"), logical.ErrInvalidRequest
+	}
+
+	numMonths := 0
+	for _, d := range input.Data {
+		if int(d.GetMonthsAgo())+1 > numMonths {
+			numMonths = int(d.GetMonthsAgo()) + 1
+		}
+	}
+	if numMonths > maxGeneratedMonths {
+		return logical.ErrorResponse("data specifies %d months, which is more than the maximum of %d", numMonths, maxGeneratedMonths), logical.ErrInvalidRequest
+	}
+
+	months := newMultipleMonthsActivityClients(numMonths)
+	for _, d := range input.Data {
+		if err := months.processMonth(ctx, b.Core, d); err != nil {
+			return logical.ErrorResponse("failed to process month: %s", err), logical.ErrInvalidRequest
+		}
+	}
+
+	paths, err := months.writeSegments(ctx, b.Core.activityLog, time.Now().UTC())
+	if err != nil {
+		return nil, err
+	}
+
+	return &logical.Response{
+		Data: map[string]interface{}{
+			"paths": paths,
+		},
+	}, nil
+}
+
+// handleActivityExportCSV streams the activity log client counters currently
+// loaded in storage back out as CSV, so that it can be diffed against the
+// CSV used to generate it with the "csv" format above.
+func (b *SystemBackend) handleActivityExportCSV(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	numMonths := d.Get("months").(int)
+	if numMonths <= 0 {
+		return logical.ErrorResponse("months must be positive"), logical.ErrInvalidRequest
+	}
+	if numMonths > maxGeneratedMonths {
+		return logical.ErrorResponse("months %d is more than the maximum of %d", numMonths, maxGeneratedMonths), logical.ErrInvalidRequest
+	}
+
+	months, err := loadMonthsFromStorage(ctx, b.Core.activityLog, time.Now().UTC(), numMonths)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load activity log segments: %w", err)
+	}
+
+	var buf bytes.Buffer
+	if err := months.writeCSV(&buf); err != nil {
+		return nil, err
+	}
+
+	return &logical.Response{
+		Data: map[string]interface{}{
+			logical.HTTPContentType: "text/csv",
+			logical.HTTPRawBody:     buf.Bytes(),
+			logical.HTTPStatusCode:  200,
+		},
+	}, nil
+}
@@ -89,6 +89,24 @@ func TestSystemBackend_handleActivityWriteData_validation(t *testing.T) {
 	}
 }
 
+// TestSystemBackend_handleActivityWriteDataSafely_panics verifies that
+// withActivityWriteRecovery turns a panic raised anywhere underneath it into
+// a logical.ErrInternal response rather than letting it crash the server.
+// generation and processMonth validate their inputs thoroughly enough that
+// none of them are known to still panic on bad input, so this exercises the
+// recovery behavior directly with a synthetic panic instead of relying on a
+// generation bug to trigger it.
+func TestSystemBackend_handleActivityWriteDataSafely_panics(t *testing.T) {
+	b := testSystemBackend(t)
+
+	resp, err := b.withActivityWriteRecovery(func() (*logical.Response, error) {
+		panic("synthetic panic for TestSystemBackend_handleActivityWriteDataSafely_panics")
+	})
+	require.True(t, resp.IsError())
+	require.Contains(t, resp.Error().Error(), "<redacted>")
+	require.Equal(t, logical.ErrInternal, err)
+}
+
 // Test_singleMonthActivityClients_addNewClients verifies that new clients are created correctly, adhering to the
 // requested parameters. The clients should have the correct namespace and mount, replaced with the default if the input
 // values are empty. The clients should have a generated ID if one is not supplied. The new client should be added to